@@ -0,0 +1,122 @@
+package sqlutil
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+)
+
+// fakeExecLog records, in order, every query executed against a fakeConn
+// opened from a particular test *sql.DB, tagged with that DB's name. Tests
+// use it to tell which underlying database a task's queries actually ran
+// against, since *sql.Tx doesn't otherwise expose its driver connection.
+type fakeExecLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *fakeExecLog) record(dbName, query string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, dbName+":"+query)
+}
+
+func (l *fakeExecLog) snapshot() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]string, len(l.calls))
+	copy(out, l.calls)
+	return out
+}
+
+// fakeDriver is a minimal database/sql/driver.Driver backing test *sql.DBs
+// that don't need to talk to a real SQLite file, only to exercise the
+// Writer implementations' queueing, nesting, batching, retry and
+// cancellation logic.
+type fakeDriver struct {
+	mu   sync.Mutex
+	logs map[string]*fakeExecLog
+}
+
+var testDriver = &fakeDriver{logs: make(map[string]*fakeExecLog)}
+
+func init() {
+	sql.Register("sqlutil_fake", testDriver)
+}
+
+// newFakeDB opens a *sql.DB backed by fakeDriver under the given name, along
+// with the fakeExecLog that will record every query run against it.
+func newFakeDB(name string) (*sql.DB, *fakeExecLog) {
+	log := &fakeExecLog{}
+	testDriver.mu.Lock()
+	testDriver.logs[name] = log
+	testDriver.mu.Unlock()
+	db, err := sql.Open("sqlutil_fake", name)
+	if err != nil {
+		panic(err)
+	}
+	return db, log
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	log, ok := d.logs[name]
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("sqlutil: no fake db registered as %q", name)
+	}
+	return &fakeConn{name: name, log: log}, nil
+}
+
+// fakeConn is a driver.Conn that also implements driver.Execer, so
+// (*sql.Tx).Exec doesn't need a driver.Stmt round trip.
+type fakeConn struct {
+	name string
+	log  *fakeExecLog
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{name: c.name, log: c.log}, nil }
+
+func (c *fakeConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	c.log.record(c.name, query)
+	return driver.ResultNoRows, nil
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.c.Exec(s.query, args)
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("sqlutil: fakeStmt does not support queries")
+}
+
+// fakeTx records its own Commit/Rollback into the same log its originating
+// fakeConn writes Exec calls to, so tests can tell which of the two fired
+// without a real driver to observe.
+type fakeTx struct {
+	name string
+	log  *fakeExecLog
+}
+
+func (t fakeTx) Commit() error {
+	if t.log != nil {
+		t.log.record(t.name, "COMMIT")
+	}
+	return nil
+}
+
+func (t fakeTx) Rollback() error {
+	if t.log != nil {
+		t.log.record(t.name, "ROLLBACK")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// Writer is an interface that can expose database access in a
+// manner that protects the integrity of the database when
+// multiple components may wish to perform writes, e.g. via
+// transactions.
+type Writer interface {
+	// Do queues a task to be run, blocking until it is complete. See
+	// ExclusiveWriter.Do for the full contract.
+	Do(db *sql.DB, txn *sql.Tx, f func(txn *sql.Tx) error) error
+	// DoContext is like Do but takes a context.Context that is threaded
+	// through to f and can be used to abandon the task, both while it is
+	// queued and while it is running.
+	DoContext(ctx context.Context, db *sql.DB, txn *sql.Tx, f func(ctx context.Context, txn *sql.Tx) error) error
+	// SafeCtx returns an empty string if ctx shows that the calling code is
+	// already running on the writer's own goroutine (for example because
+	// it is itself inside a Do/DoContext callback), and otherwise a
+	// description of why not. It exists so storage code can assert it is,
+	// or isn't, running on the writer goroutine.
+	SafeCtx(ctx context.Context) string
+	// Transact runs f inside a transaction and commits it, in the manner of
+	// CockroachDB's client.DB.Txn: if f or the commit fails with a retryable
+	// serialization error, the transaction is discarded and f is replayed
+	// against a fresh *sql.Tx, until f has run MaxTransactionRetries times
+	// in all. f's return value is only surfaced once a replay actually commits, so
+	// callers never observe the result of an attempt that was rolled back.
+	Transact(db *sql.DB, f func(txn *sql.Tx) (any, error)) (any, error)
+}
+
+// MaxTransactionRetries is the maximum number of times in total, counting
+// the first attempt, that Writer.Transact will run a transaction whose
+// attempts keep failing with a retryable error.
+const MaxTransactionRetries = 10
+
+// isRetryableTxnError reports whether err represents a serialization
+// conflict that is safe to resolve by discarding the transaction and
+// replaying its closure: SQLite's SQLITE_BUSY family, or Postgres'
+// serialization_failure (40001) and deadlock_detected (40P01).
+func isRetryableTxnError(err error) bool {
+	if isBusyError(err) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "40001") || strings.Contains(msg, "40P01")
+}
+
+// noRetryDoer is implemented by a Writer whose DoContext applies its own
+// busy-retry policy on top of running f, e.g. ExclusiveWriter's
+// RetryPolicy. transact uses doContextNoRetry instead of DoContext when
+// available so that its own replay loop is the only thing retrying a busy
+// error; otherwise the two layers would both fire on the same error and
+// compound into far more attempts, and far more backoff, than
+// MaxTransactionRetries promises on its own.
+type noRetryDoer interface {
+	doContextNoRetry(ctx context.Context, db *sql.DB, txn *sql.Tx, f func(ctx context.Context, txn *sql.Tx) error) error
+}
+
+// transact implements Writer.Transact on top of w.DoContext (or
+// doContextNoRetry, where w implements noRetryDoer), and is shared by every
+// Writer implementation. A replaying task is simply re-submitted through the
+// same call, so with ExclusiveWriter it naturally goes to the back of the
+// queue rather than retrying inline and starving other callers.
+func transact(w Writer, db *sql.DB, f func(txn *sql.Tx) (any, error)) (any, error) {
+	doContext := w.DoContext
+	if nr, ok := w.(noRetryDoer); ok {
+		doContext = nr.doContextNoRetry
+	}
+	var result any
+	for attempt := 1; ; attempt++ {
+		var fErr error
+		err := doContext(context.Background(), db, nil, func(_ context.Context, txn *sql.Tx) error {
+			result, fErr = f(txn)
+			return fErr
+		})
+		if err == nil {
+			return result, nil
+		}
+		if attempt >= MaxTransactionRetries || !isRetryableTxnError(err) {
+			return nil, err
+		}
+	}
+}
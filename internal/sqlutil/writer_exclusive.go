@@ -1,47 +1,171 @@
 package sqlutil
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"runtime"
-	"strconv"
+	"math/rand"
 	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/atomic"
 )
 
+// writerTokenKey is the context key used to mark that code is running on
+// behalf of an ExclusiveWriter's run loop.
+type writerTokenKey struct{}
+
+// writerFrame is the value stored under writerTokenKey{} while a task is
+// executing: which writer it's running on (for SafeCtx), and the db/txn it
+// opened, so a same-writer nested call can recover and reuse that
+// transaction instead of opening a second one. A nested call that opened
+// its own transaction on the same db would deadlock, since the outer
+// transaction already holds whatever lock the database serialises writes
+// on (e.g. SQLite's single write lock) until the callback that's blocked
+// waiting on the nested call returns.
+type writerFrame struct {
+	w   *ExclusiveWriter
+	db  *sql.DB
+	txn *sql.Tx
+}
+
+// RetryPolicy controls how ExclusiveWriter retries a task whose f returns a
+// transient SQLITE_BUSY-style error.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times f will be invoked in total.
+	// A value <= 1 disables retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry; each subsequent retry
+	// doubles the previous delay, plus a little jitter.
+	BaseDelay time.Duration
+	// IsBusy reports whether err represents a transient lock error that is
+	// safe to retry by replaying f in a fresh transaction. The default,
+	// used by NewExclusiveWriter, matches modernc.org/sqlite's error
+	// strings; callers using a different driver (e.g. ncruces/go-sqlite3's
+	// WASM build) should supply their own, since error shapes differ
+	// between drivers.
+	IsBusy func(err error) bool
+}
+
+// DefaultRetryPolicy invokes f up to 8 times in total (7 retries), starting
+// with an 8ms delay that doubles on each retry.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 8,
+	BaseDelay:   8 * time.Millisecond,
+	IsBusy:      isBusyError,
+}
+
+func isBusyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "SQLITE_BUSY") || strings.Contains(msg, "SQLITE_LOCKED")
+}
+
+// BatchPolicy controls how ExclusiveWriter.DoBatch coalesces adjacent tasks
+// onto a single underlying transaction.
+type BatchPolicy struct {
+	// MaxSize is the maximum number of tasks coalesced onto one
+	// transaction. A value <= 1 disables batching.
+	MaxSize int
+	// MaxWait is how long to wait for additional tasks to arrive before
+	// opening the transaction with however many have been collected so
+	// far.
+	MaxWait time.Duration
+}
+
+// DefaultBatchPolicy coalesces up to 32 tasks, waiting up to 2ms for them to
+// arrive before committing whatever has accumulated.
+var DefaultBatchPolicy = BatchPolicy{
+	MaxSize: 32,
+	MaxWait: 2 * time.Millisecond,
+}
+
 // ExclusiveWriter implements sqlutil.Writer.
 // ExclusiveWriter allows queuing database writes so that you don't
 // contend on database locks in, e.g. SQLite. Only one task will run
 // at a time on a given ExclusiveWriter.
 type ExclusiveWriter struct {
-	running  atomic.Bool
-	todo     chan transactionWriterTask
-	writerID int
+	running atomic.Bool
+	todo    chan transactionWriterTask
+	retry   RetryPolicy
+	batch   BatchPolicy
+
+	mu     sync.Mutex
+	active context.Context
 }
 
 func NewExclusiveWriter() Writer {
+	return NewExclusiveWriterWithRetry(DefaultRetryPolicy)
+}
+
+// NewExclusiveWriterWithRetry is like NewExclusiveWriter but lets the caller
+// configure when a failed task is replayed. f passed to Do/DoContext must be
+// idempotent, since policy.IsBusy errors cause it to be invoked again with a
+// fresh *sql.Tx after rolling back the failed attempt.
+func NewExclusiveWriterWithRetry(policy RetryPolicy) Writer {
+	return &ExclusiveWriter{
+		todo:  make(chan transactionWriterTask),
+		retry: policy,
+	}
+}
+
+// NewExclusiveWriterWithBatching is like NewExclusiveWriter but additionally
+// coalesces adjacent DoBatch calls onto a single transaction per policy, to
+// amortise the cost of a commit across all of them.
+func NewExclusiveWriterWithBatching(policy BatchPolicy) Writer {
 	return &ExclusiveWriter{
-		todo: make(chan transactionWriterTask),
+		todo:  make(chan transactionWriterTask),
+		retry: DefaultRetryPolicy,
+		batch: policy,
 	}
 }
 
 // transactionWriterTask represents a specific task.
 type transactionWriterTask struct {
-	db   *sql.DB
-	txn  *sql.Tx
-	f    func(txn *sql.Tx) error
-	wait chan error
+	ctx     context.Context
+	db      *sql.DB
+	txn     *sql.Tx
+	f       func(ctx context.Context, txn *sql.Tx) error
+	batch   bool
+	noRetry bool
+	wait    chan error
 }
 
-func (w *ExclusiveWriter) Safe() string {
-	a := goid()
-	b := w.writerID
-	if a == b {
+// SafeCtx reports whether ctx carries this writer's reentrancy token, i.e.
+// whether the calling code is already running on the writer goroutine. This
+// replaces the previous goroutine-ID comparison, which parsed
+// runtime.Stack() output - slow, and documented by the Go team as unsafe to
+// rely on.
+func (w *ExclusiveWriter) SafeCtx(ctx context.Context) string {
+	if frame, _ := ctx.Value(writerTokenKey{}).(*writerFrame); frame != nil && frame.w == w {
 		return ""
 	}
-	return fmt.Sprintf("%v != %v", a, b)
+	return "context is not running on the writer goroutine"
+}
+
+// ambientCtx returns the context.Context most recently tagged by
+// runWithContext for the task currently executing on w, or
+// context.Background() if none is. Do's callback is a plain
+// func(txn *sql.Tx) error with no ctx parameter, so unlike DoContext's
+// callers, it has no way to thread the reentrancy token through by hand
+// when it wants to call Do again; Do recovers it from here instead.
+func (w *ExclusiveWriter) ambientCtx() context.Context {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.active == nil {
+		return context.Background()
+	}
+	return w.active
+}
+
+func (w *ExclusiveWriter) setActive(ctx context.Context) {
+	w.mu.Lock()
+	w.active = ctx
+	w.mu.Unlock()
 }
 
 // Do queues a task to be run by a TransactionWriter. The function
@@ -49,7 +173,101 @@ func (w *ExclusiveWriter) Safe() string {
 // txn parameter if one is supplied, and if not, will take out a
 // new transaction from the database supplied in the database
 // parameter. Either way, this will block until the task is done.
+//
+// A Do call made from a callback that's itself running inside a Do/
+// DoContext on the same writer picks up that callback's reentrancy token
+// via ambientCtx, so it runs inline rather than deadlocking on the queue.
 func (w *ExclusiveWriter) Do(db *sql.DB, txn *sql.Tx, f func(txn *sql.Tx) error) error {
+	return w.DoContext(w.ambientCtx(), db, txn, func(_ context.Context, txn *sql.Tx) error {
+		return f(txn)
+	})
+}
+
+// DoContext is like Do but takes a context.Context that is threaded through
+// to f, so long-running queries can be cancelled mid-transaction. If ctx is
+// done before the task reaches the front of the queue, DoContext returns
+// ctx.Err() without ever invoking f. If ctx expires while f is running, the
+// transaction's Rollback is called right away rather than waiting for f to
+// finish - but Rollback is serialised against any statement f already has
+// in flight on the same *sql.Tx, so this can't preempt a call that isn't
+// itself context-aware; f should use txn.ExecContext/QueryContext with ctx
+// if it wants ctx's cancellation to actually abort its work promptly.
+func (w *ExclusiveWriter) DoContext(ctx context.Context, db *sql.DB, txn *sql.Tx, f func(ctx context.Context, txn *sql.Tx) error) error {
+	return w.doContext(ctx, db, txn, f, false)
+}
+
+// doContextNoRetry is like DoContext but disables w.retry: it implements
+// noRetryDoer so that Writer.Transact's replay loop is the only thing
+// retrying a busy error, rather than compounding with w.retry's own
+// busy-retry on every replay.
+func (w *ExclusiveWriter) doContextNoRetry(ctx context.Context, db *sql.DB, txn *sql.Tx, f func(ctx context.Context, txn *sql.Tx) error) error {
+	return w.doContext(ctx, db, txn, f, true)
+}
+
+func (w *ExclusiveWriter) doContext(ctx context.Context, db *sql.DB, txn *sql.Tx, f func(ctx context.Context, txn *sql.Tx) error, noRetry bool) error {
+	if w.SafeCtx(ctx) == "" {
+		// ctx shows we're already running on the writer goroutine, e.g.
+		// because this is a Do/DoContext call nested inside another one's
+		// callback. Run inline instead of deadlocking on the unbuffered
+		// todo channel waiting for a goroutine that is blocked on us.
+		return w.runNested(ctx, db, txn, f)
+	}
+	if w.todo == nil {
+		return errors.New("not initialised")
+	}
+	if !w.running.Load() {
+		go w.run()
+	}
+	task := transactionWriterTask{
+		ctx:     ctx,
+		db:      db,
+		txn:     txn,
+		f:       f,
+		noRetry: noRetry,
+		wait:    make(chan error, 1),
+	}
+	select {
+	case w.todo <- task:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-task.wait:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runNested runs f on the calling goroutine without going through todo, for
+// a DoContext call made from within another task's callback. A nested call
+// that names the same db as the ambient transaction reuses it rather than
+// opening a second one: the outer transaction already holds whatever lock
+// the database serialises writes on (e.g. SQLite's single write lock) until
+// the outer callback - the very thing blocked waiting on this nested call -
+// returns, so a second, independent transaction on the same db would
+// self-deadlock.
+func (w *ExclusiveWriter) runNested(ctx context.Context, db *sql.DB, txn *sql.Tx, f func(ctx context.Context, txn *sql.Tx) error) error {
+	if txn != nil {
+		return f(ctx, txn)
+	}
+	if frame, _ := ctx.Value(writerTokenKey{}).(*writerFrame); frame != nil && frame.txn != nil && db == frame.db {
+		return f(ctx, frame.txn)
+	}
+	if db != nil {
+		return WithTransaction(db, func(txn *sql.Tx) error {
+			return f(ctx, txn)
+		})
+	}
+	return f(ctx, nil)
+}
+
+// DoBatch queues f to run in a transaction shared with other adjacent
+// DoBatch calls, amortising the cost of a commit across all of them
+// according to w's BatchPolicy. f runs inside its own savepoint, so if it
+// errors only it is rolled back; sibling tasks in the same batch still
+// commit.
+func (w *ExclusiveWriter) DoBatch(db *sql.DB, f func(txn *sql.Tx) error) error {
 	if w.todo == nil {
 		return errors.New("not initialised")
 	}
@@ -57,10 +275,11 @@ func (w *ExclusiveWriter) Do(db *sql.DB, txn *sql.Tx, f func(txn *sql.Tx) error)
 		go w.run()
 	}
 	task := transactionWriterTask{
-		db:   db,
-		txn:  txn,
-		f:    f,
-		wait: make(chan error, 1),
+		ctx:   context.Background(),
+		db:    db,
+		f:     func(_ context.Context, txn *sql.Tx) error { return f(txn) },
+		batch: true,
+		wait:  make(chan error, 1),
 	}
 	w.todo <- task
 	return <-task.wait
@@ -74,29 +293,184 @@ func (w *ExclusiveWriter) run() {
 	if !w.running.CAS(false, true) {
 		return
 	}
-	w.writerID = goid()
 	defer w.running.Store(false)
 	for task := range w.todo {
-		if task.db != nil && task.txn != nil {
-			task.wait <- task.f(task.txn)
-		} else if task.db != nil && task.txn == nil {
-			task.wait <- WithTransaction(task.db, func(txn *sql.Tx) error {
-				return task.f(txn)
+		if !task.batch {
+			task.wait <- w.execute(task)
+			close(task.wait)
+			continue
+		}
+		w.runBatch(task)
+	}
+}
+
+// runBatch collects up to w.batch.MaxSize adjacent DoBatch tasks targeting
+// the same *sql.DB as first, waiting at most w.batch.MaxWait for more of
+// them to arrive, then commits them all together in commitBatch. A task that
+// arrives during collection ends the batch rather than joining it if it
+// isn't a DoBatch task at all, in which case it is then executed on its own,
+// or if it names a different db, in which case it starts the next batch:
+// DoBatch takes db per call, so nothing stops two calls on the same Writer from targeting
+// different databases, and commitBatch must never coalesce tasks from more
+// than one of them onto a single transaction.
+func (w *ExclusiveWriter) runBatch(first transactionWriterTask) {
+	for {
+		next, ok := w.collectBatch(first)
+		if !ok {
+			return
+		}
+		first = next
+	}
+}
+
+// collectBatch gathers and commits one batch starting with first, as
+// described by runBatch. It reports the next task to start a following
+// batch with, if one arrived during collection but didn't belong in this
+// one; a non-batch task is instead executed directly, preserving arrival
+// order, and collectBatch reports no further batch to start.
+func (w *ExclusiveWriter) collectBatch(first transactionWriterTask) (transactionWriterTask, bool) {
+	maxSize := w.batch.MaxSize
+	if maxSize <= 1 {
+		w.commitBatch([]transactionWriterTask{first})
+		return transactionWriterTask{}, false
+	}
+	tasks := []transactionWriterTask{first}
+	timer := time.NewTimer(w.batch.MaxWait)
+	defer timer.Stop()
+	for len(tasks) < maxSize {
+		select {
+		case task := <-w.todo:
+			if !task.batch || task.db != first.db {
+				w.commitBatch(tasks)
+				if !task.batch {
+					task.wait <- w.execute(task)
+					close(task.wait)
+					return transactionWriterTask{}, false
+				}
+				return task, true
+			}
+			tasks = append(tasks, task)
+		case <-timer.C:
+			w.commitBatch(tasks)
+			return transactionWriterTask{}, false
+		}
+	}
+	w.commitBatch(tasks)
+	return transactionWriterTask{}, false
+}
+
+// commitBatch runs each task's f inside its own savepoint on a single shared
+// transaction and commits once. A task whose f errors is rolled back to its
+// savepoint alone; every task, successful or not, is also bound by the
+// outcome of the final commit.
+func (w *ExclusiveWriter) commitBatch(tasks []transactionWriterTask) {
+	results := make([]error, len(tasks))
+	commitErr := WithTransaction(tasks[0].db, func(txn *sql.Tx) error {
+		for i, task := range tasks {
+			i, task := i, task
+			results[i] = runInSavepoint(txn, fmt.Sprintf("batch%d", i), func() error {
+				return w.runWithContext(task.ctx, task.db, txn, task.f)
 			})
-		} else {
-			task.wait <- task.f(nil)
 		}
+		return nil
+	})
+	for i, task := range tasks {
+		err := results[i]
+		if err == nil {
+			err = commitErr
+		}
+		task.wait <- err
 		close(task.wait)
 	}
 }
 
-func goid() int {
-	var buf [64]byte
-	n := runtime.Stack(buf[:], false)
-	idField := strings.Fields(strings.TrimPrefix(string(buf[:n]), "goroutine "))[0]
-	id, err := strconv.Atoi(idField)
-	if err != nil {
-		panic(fmt.Sprintf("cannot get goroutine id: %v", err))
+// runInSavepoint runs f inside a named savepoint on txn, rolling back to the
+// savepoint alone (not the whole transaction) if f errors.
+func runInSavepoint(txn *sql.Tx, name string, f func() error) error {
+	if _, err := txn.Exec("SAVEPOINT " + name); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		if _, rbErr := txn.Exec("ROLLBACK TO SAVEPOINT " + name); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+	_, err := txn.Exec("RELEASE SAVEPOINT " + name)
+	return err
+}
+
+// execute runs a single task to completion, opening a transaction from
+// task.db if the caller didn't already supply one in task.txn.
+func (w *ExclusiveWriter) execute(task transactionWriterTask) error {
+	if task.db != nil && task.txn != nil {
+		return w.runWithContext(task.ctx, task.db, task.txn, task.f)
+	} else if task.db != nil && task.txn == nil {
+		return w.executeWithRetry(task)
 	}
-	return id
-}
\ No newline at end of file
+	return w.runWithContext(task.ctx, nil, nil, task.f)
+}
+
+// executeWithRetry runs task.f inside a fresh transaction from task.db,
+// replaying it against another fresh transaction if it fails with an error
+// that w.retry.IsBusy considers transient, up to w.retry.MaxAttempts times.
+// task.noRetry disables this and runs f exactly once, for callers such as
+// Writer.Transact that apply their own replay loop and would otherwise
+// compound it with w.retry's.
+func (w *ExclusiveWriter) executeWithRetry(task transactionWriterTask) error {
+	maxAttempts := w.retry.MaxAttempts
+	if task.noRetry {
+		maxAttempts = 1
+	}
+	delay := w.retry.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := WithTransaction(task.db, func(txn *sql.Tx) error {
+			return w.runWithContext(task.ctx, task.db, txn, task.f)
+		})
+		if err == nil || task.ctx.Err() != nil {
+			return err
+		}
+		if w.retry.IsBusy == nil || !w.retry.IsBusy(err) || attempt >= maxAttempts {
+			return err
+		}
+		sleep := delay + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(sleep):
+		case <-task.ctx.Done():
+			return task.ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// runWithContext tags ctx with this writer's reentrancy token, along with
+// the db/txn f is running against so a nested call can recover and reuse
+// them, and invokes f. If ctx is done before f returns, it rolls back txn
+// and returns ctx.Err() rather than waiting for f to finish.
+func (w *ExclusiveWriter) runWithContext(ctx context.Context, db *sql.DB, txn *sql.Tx, f func(ctx context.Context, txn *sql.Tx) error) error {
+	ctx = context.WithValue(ctx, writerTokenKey{}, &writerFrame{w: w, db: db, txn: txn})
+	w.setActive(ctx)
+	defer w.setActive(nil)
+	if ctx.Done() == nil {
+		return f(ctx, txn)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f(ctx, txn)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if txn != nil {
+			_ = txn.Rollback()
+		}
+		return ctx.Err()
+	}
+}
+
+// Transact implements Writer.Transact; see its docs for the replay
+// semantics.
+func (w *ExclusiveWriter) Transact(db *sql.DB, f func(txn *sql.Tx) (any, error)) (any, error) {
+	return transact(w, db, f)
+}
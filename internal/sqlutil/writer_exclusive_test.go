@@ -0,0 +1,305 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestExclusiveWriterRecursiveDoContext exercises a DoContext call made from
+// within another DoContext's callback. Before SafeCtx replaced the
+// goroutine-ID check, this would deadlock: the outer callback runs on the
+// writer goroutine, and the inner call would block forever trying to send
+// on the unbuffered todo channel to the same, now-busy, goroutine.
+func TestExclusiveWriterRecursiveDoContext(t *testing.T) {
+	w := NewExclusiveWriter()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.DoContext(context.Background(), nil, nil, func(ctx context.Context, _ *sql.Tx) error {
+			return w.DoContext(ctx, nil, nil, func(context.Context, *sql.Tx) error {
+				return nil
+			})
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("recursive DoContext returned an error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("recursive DoContext did not return; want no deadlock")
+	}
+}
+
+// TestExclusiveWriterRecursiveDo is like TestExclusiveWriterRecursiveDoContext
+// but exercises plain Do, whose callback has no ctx parameter to thread the
+// reentrancy token through by hand. Against a real *sql.DB limited to a
+// single connection, a naive nested Do would deadlock twice over: SafeCtx
+// wouldn't recognise the inner call as nested without the token, and even if
+// it did, opening a second transaction on the same db would block forever
+// waiting for a connection the outer, still-open transaction is holding.
+func TestExclusiveWriterRecursiveDo(t *testing.T) {
+	db, log := newFakeDB("TestExclusiveWriterRecursiveDo")
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	w := NewExclusiveWriter()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Do(db, nil, func(txn *sql.Tx) error {
+			if _, err := txn.Exec("OUTER"); err != nil {
+				return err
+			}
+			return w.Do(db, nil, func(txn *sql.Tx) error {
+				_, err := txn.Exec("INNER")
+				return err
+			})
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("recursive Do returned an error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("recursive Do did not return; want no deadlock")
+	}
+
+	want := []string{
+		"TestExclusiveWriterRecursiveDo:OUTER",
+		"TestExclusiveWriterRecursiveDo:INNER",
+		"TestExclusiveWriterRecursiveDo:COMMIT",
+	}
+	if calls := log.snapshot(); !reflect.DeepEqual(calls, want) {
+		t.Fatalf("queries = %v, want %v", calls, want)
+	}
+}
+
+// TestDoBatchDoesNotMixDatabases exercises two DoBatch calls against
+// different *sql.DBs submitted back to back on the same ExclusiveWriter. If
+// commitBatch coalesced them onto a single transaction regardless of which
+// db each task named, the second task's query would run against the first
+// task's database instead of its own.
+func TestDoBatchDoesNotMixDatabases(t *testing.T) {
+	w := NewExclusiveWriterWithBatching(BatchPolicy{MaxSize: 8, MaxWait: 50 * time.Millisecond}).(*ExclusiveWriter)
+
+	db1, log1 := newFakeDB("TestDoBatchDoesNotMixDatabases-1")
+	db2, log2 := newFakeDB("TestDoBatchDoesNotMixDatabases-2")
+	defer db1.Close()
+	defer db2.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var err1, err2 error
+	go func() {
+		defer wg.Done()
+		err1 = w.DoBatch(db1, func(txn *sql.Tx) error {
+			_, err := txn.Exec("TASK1")
+			return err
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		err2 = w.DoBatch(db2, func(txn *sql.Tx) error {
+			_, err := txn.Exec("TASK2")
+			return err
+		})
+	}()
+	wg.Wait()
+	if err1 != nil || err2 != nil {
+		t.Fatalf("DoBatch returned errors: %v, %v", err1, err2)
+	}
+
+	want1 := []string{
+		"TestDoBatchDoesNotMixDatabases-1:SAVEPOINT batch0",
+		"TestDoBatchDoesNotMixDatabases-1:TASK1",
+		"TestDoBatchDoesNotMixDatabases-1:RELEASE SAVEPOINT batch0",
+		"TestDoBatchDoesNotMixDatabases-1:COMMIT",
+	}
+	want2 := []string{
+		"TestDoBatchDoesNotMixDatabases-2:SAVEPOINT batch0",
+		"TestDoBatchDoesNotMixDatabases-2:TASK2",
+		"TestDoBatchDoesNotMixDatabases-2:RELEASE SAVEPOINT batch0",
+		"TestDoBatchDoesNotMixDatabases-2:COMMIT",
+	}
+	if calls1 := log1.snapshot(); !reflect.DeepEqual(calls1, want1) {
+		t.Fatalf("db1 queries = %v, want only its own task's %v", calls1, want1)
+	}
+	if calls2 := log2.snapshot(); !reflect.DeepEqual(calls2, want2) {
+		t.Fatalf("db2 queries = %v, want only its own task's %v", calls2, want2)
+	}
+}
+
+// TestExecuteWithRetryRetriesBusyErrors checks that a task whose f fails
+// with a busy-class error is replayed with a fresh transaction, up to the
+// configured RetryPolicy.MaxAttempts, and that a successful attempt stops
+// the retry loop.
+func TestExecuteWithRetryRetriesBusyErrors(t *testing.T) {
+	db, _ := newFakeDB("TestExecuteWithRetryRetriesBusyErrors")
+	defer db.Close()
+
+	w := NewExclusiveWriterWithRetry(RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		IsBusy:      isBusyError,
+	})
+
+	attempts := 0
+	err := w.Do(db, nil, func(txn *sql.Tx) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("SQLITE_BUSY: database is locked")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do returned an error: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("f ran %d times, want 3 (1 initial + 2 retries)", attempts)
+	}
+
+	attempts = 0
+	err = w.Do(db, nil, func(txn *sql.Tx) error {
+		attempts++
+		return errors.New("SQLITE_BUSY: database is locked")
+	})
+	if err == nil {
+		t.Fatal("Do succeeded, want the persistent busy error")
+	}
+	if attempts != 3 {
+		t.Fatalf("f ran %d times, want exactly RetryPolicy.MaxAttempts (3)", attempts)
+	}
+}
+
+// TestTransactDoesNotCompoundWriterRetries guards against Transact's replay
+// loop and ExclusiveWriter's own RetryPolicy both firing on the same busy
+// error: if they weren't coordinated, a persistently busy f could be
+// invoked MaxTransactionRetries*RetryPolicy.MaxAttempts times instead of
+// just MaxTransactionRetries times.
+func TestTransactDoesNotCompoundWriterRetries(t *testing.T) {
+	db, _ := newFakeDB("TestTransactDoesNotCompoundWriterRetries")
+	defer db.Close()
+
+	w := NewExclusiveWriterWithRetry(RetryPolicy{
+		MaxAttempts: 8,
+		BaseDelay:   time.Millisecond,
+		IsBusy:      isBusyError,
+	})
+
+	attempts := 0
+	_, err := w.Transact(db, func(txn *sql.Tx) (any, error) {
+		attempts++
+		return nil, errors.New("SQLITE_BUSY: database is locked")
+	})
+	if err == nil {
+		t.Fatal("Transact succeeded, want the persistent busy error")
+	}
+	if attempts != MaxTransactionRetries {
+		t.Fatalf("f ran %d times, want exactly MaxTransactionRetries (%d); "+
+			"Transact's replay loop must bypass the writer's own RetryPolicy "+
+			"rather than compounding with it", attempts, MaxTransactionRetries)
+	}
+}
+
+// TestDoContextCancelledWhileQueuedNeverRunsF checks that a DoContext call
+// stuck waiting for a busy writer returns ctx.Err() as soon as its ctx is
+// cancelled, without ever invoking f once the writer does get around to it.
+func TestDoContextCancelledWhileQueuedNeverRunsF(t *testing.T) {
+	db, _ := newFakeDB("TestDoContextCancelledWhileQueuedNeverRunsF")
+	defer db.Close()
+
+	w := NewExclusiveWriter()
+
+	firstStarted := make(chan struct{})
+	unblockFirst := make(chan struct{})
+	firstDone := make(chan error, 1)
+	go func() {
+		firstDone <- w.Do(db, nil, func(txn *sql.Tx) error {
+			close(firstStarted)
+			<-unblockFirst
+			return nil
+		})
+	}()
+	<-firstStarted
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := false
+	secondDone := make(chan error, 1)
+	go func() {
+		secondDone <- w.DoContext(ctx, db, nil, func(context.Context, *sql.Tx) error {
+			ran = true
+			return nil
+		})
+	}()
+
+	// Give the second call a moment to actually block trying to queue
+	// behind the first before cancelling it, so this exercises cancellation
+	// while queued rather than before the call even starts.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-secondDone:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("DoContext returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DoContext did not return after its ctx was cancelled")
+	}
+	if ran {
+		t.Fatal("f ran even though ctx was cancelled before the task reached the front of the queue")
+	}
+
+	close(unblockFirst)
+	if err := <-firstDone; err != nil {
+		t.Fatalf("first Do returned an error: %v", err)
+	}
+}
+
+// TestDoContextRollsBackOnCancelMidExecution checks that cancelling ctx
+// while f is running rolls back the transaction rather than leaving it
+// open, even though DoContext returns before f itself returns.
+func TestDoContextRollsBackOnCancelMidExecution(t *testing.T) {
+	db, log := newFakeDB("TestDoContextRollsBackOnCancelMidExecution")
+	defer db.Close()
+
+	w := NewExclusiveWriter()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan struct{})
+	unblockF := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- w.DoContext(ctx, db, nil, func(ctx context.Context, txn *sql.Tx) error {
+			close(started)
+			<-unblockF
+			return nil
+		})
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("DoContext returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DoContext did not return after its ctx was cancelled")
+	}
+
+	calls := log.snapshot()
+	if len(calls) == 0 || calls[len(calls)-1] != "TestDoContextRollsBackOnCancelMidExecution:ROLLBACK" {
+		t.Fatalf("queries = %v, want the transaction to have been rolled back", calls)
+	}
+	close(unblockF)
+}
@@ -0,0 +1,123 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncUnlockNotifyConn is a driver.Conn that also implements UnlockNotifier.
+// Its Exec looks busy until RegisterUnlockNotify is called, which clears
+// that and then invokes its
+// callback synchronously, before returning, as sqlite3_unlock_notify itself
+// may do when the lock has already cleared by the time of registration.
+type syncUnlockNotifyConn struct {
+	mu   sync.Mutex
+	busy bool
+}
+
+func (c *syncUnlockNotifyConn) Prepare(query string) (driver.Stmt, error) {
+	return &syncUnlockNotifyStmt{c}, nil
+}
+func (c *syncUnlockNotifyConn) Close() error              { return nil }
+func (c *syncUnlockNotifyConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c *syncUnlockNotifyConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	c.mu.Lock()
+	busy := c.busy
+	c.mu.Unlock()
+	if busy {
+		return nil, errors.New("SQLITE_LOCKED_SHAREDCACHE: database table is locked")
+	}
+	return driver.ResultNoRows, nil
+}
+
+// RegisterUnlockNotify implements UnlockNotifier, invoking cb synchronously
+// to simulate the documented sqlite3_unlock_notify race.
+func (c *syncUnlockNotifyConn) RegisterUnlockNotify(cb func()) error {
+	c.mu.Lock()
+	c.busy = false
+	c.mu.Unlock()
+	cb()
+	return nil
+}
+
+type syncUnlockNotifyStmt struct{ c *syncUnlockNotifyConn }
+
+func (s *syncUnlockNotifyStmt) Close() error  { return nil }
+func (s *syncUnlockNotifyStmt) NumInput() int { return -1 }
+func (s *syncUnlockNotifyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.c.Exec("", args)
+}
+func (s *syncUnlockNotifyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("sqlutil: syncUnlockNotifyStmt does not support queries")
+}
+
+type syncUnlockNotifyDriver struct{ conn *syncUnlockNotifyConn }
+
+func (d *syncUnlockNotifyDriver) Open(name string) (driver.Conn, error) { return d.conn, nil }
+
+func init() {
+	sql.Register("sqlutil_sync_unlock_notify", &syncUnlockNotifyDriver{
+		conn: &syncUnlockNotifyConn{busy: true},
+	})
+}
+
+// TestUnlockNotifyWriterSynchronousCallback exercises the documented
+// sqlite3_unlock_notify race where the driver invokes the callback
+// synchronously, before RegisterUnlockNotify returns, because the lock
+// cleared in between the failed statement and registration.
+func TestUnlockNotifyWriterSynchronousCallback(t *testing.T) {
+	db, err := sql.Open("sqlutil_sync_unlock_notify", "TestUnlockNotifyWriterSynchronousCallback")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	w := NewUnlockNotifyWriter()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Do(db, nil, func(txn *sql.Tx) error {
+			_, err := txn.Exec("SELECT 1")
+			return err
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Do returned an error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Do did not return; want no deadlock on a synchronous unlock_notify callback")
+	}
+}
+
+// TestUnlockNotifyWriterFallsBackWithoutNotifier checks that a db whose
+// driver doesn't implement UnlockNotifier is handled by the
+// ExclusiveWriter-backed fallback rather than erroring out.
+func TestUnlockNotifyWriterFallsBackWithoutNotifier(t *testing.T) {
+	db, _ := newFakeDB("TestUnlockNotifyWriterFallsBackWithoutNotifier")
+	defer db.Close()
+
+	w := NewUnlockNotifyWriter()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ran := false
+	if err := w.DoContext(ctx, db, nil, func(context.Context, *sql.Tx) error {
+		ran = true
+		return nil
+	}); err != nil {
+		t.Fatalf("DoContext returned an error: %v", err)
+	}
+	if !ran {
+		t.Fatal("f never ran")
+	}
+}